@@ -0,0 +1,74 @@
+//go:build embed
+
+package main
+
+// Runtime support for the `embed` build tag. Building with
+//
+//	go generate && go build -tags embed
+//
+// bakes the contents of _site/ into the binary (see genassets.go and the
+// generated assets_gen.go) so that `site serve` can run as a single,
+// self-contained executable with no dependency on the filesystem it was
+// built on.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const embedded = true
+
+// embeddedFile is one entry produced by genassets.go. gzip holds the
+// file's contents compressed at the best level; etag is a quoted
+// SHA-256 digest of the uncompressed contents.
+type embeddedFile struct {
+	gzip        []byte
+	etag        string
+	contentType string
+}
+
+// newEmbeddedHandler serves generatedAssets directly, preferring
+// pre-gzipped bytes for clients that accept them.
+func newEmbeddedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+		name = strings.TrimPrefix(name, "/")
+
+		f, ok := generatedAssets[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", f.contentType)
+		header.Set("ETag", f.etag)
+		header.Set("Vary", "Accept-Encoding")
+
+		if inm := r.Header.Get("If-None-Match"); inm != "" && inm == f.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			header.Set("Content-Encoding", "gzip")
+			w.Write(f.gzip)
+			return
+		}
+
+		gr, err := gzip.NewReader(bytes.NewReader(f.gzip))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer gr.Close()
+
+		io.Copy(w, gr)
+	})
+}
@@ -0,0 +1,125 @@
+//go:build ignore
+
+// genassets walks a directory and emits a Go source file defining
+// generatedAssets, a map from path to embeddedFile, for use by the
+// `embed` build tag (see embed.go). Run via `go generate`.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", "_site", "directory to embed")
+	out := flag.String("out", "assets_gen.go", "output file")
+	flag.Parse()
+
+	assets := map[string]embeddedFile{}
+
+	err := filepath.Walk(*dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(*dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var gz bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(b); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(b)
+
+		ctype := mime.TypeByExtension(filepath.Ext(path))
+		if ctype == "" {
+			ctype = http.DetectContentType(b)
+		}
+
+		assets[rel] = embeddedFile{
+			gzip:        gz.Bytes(),
+			etag:        fmt.Sprintf("\"%x\"", sum),
+			contentType: ctype,
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by genassets.go; DO NOT EDIT.")
+	fmt.Fprintln(&buf, "//go:build embed")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "package main")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "var generatedAssets = map[string]*embeddedFile{")
+	for rel, f := range assets {
+		fmt.Fprintf(&buf, "\t%q: {\n", rel)
+		fmt.Fprintf(&buf, "\t\tgzip:        %s,\n", goBytes(f.gzip))
+		fmt.Fprintf(&buf, "\t\tetag:        %q,\n", f.etag)
+		fmt.Fprintf(&buf, "\t\tcontentType: %q,\n", f.contentType)
+		fmt.Fprintln(&buf, "\t},")
+	}
+	fmt.Fprintln(&buf, "}")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// embeddedFile mirrors the type of the same name in embed.go; genassets
+// is compiled standalone (build tag ignore) so it cannot import it.
+type embeddedFile struct {
+	gzip        []byte
+	etag        string
+	contentType string
+}
+
+// goBytes renders b as a Go []byte literal.
+func goBytes(b []byte) string {
+	var sb strings.Builder
+	sb.WriteString("[]byte{")
+	for i, c := range b {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%d", c)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+//go:generate go run genassets.go -dir _site -out assets_gen.go
+
+import (
+	"fmt"
+	"os"
+)
+
+// site is a small command line tool for building and previewing the
+// static site generated into _site/.
+//
+// Usage:
+//
+//	site <command> [arguments]
+const usage = `site is a tool for working with the generated site.
+
+Usage:
+
+	site <command> [arguments]
+
+The commands are:
+
+	serve    run a local development server
+	minify   minify HTML, CSS and JS files in place
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	cmd := os.Args[1]
+	args := os.Args[2:]
+
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "minify":
+		runMinify(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "site: unknown command %q\n\n", cmd)
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+// Minification of the generated HTML, CSS and JavaScript under _site/.
+//
+// Minifiers are pluggable behind the Minifier interface so the default,
+// fairly conservative implementation below can be swapped out without
+// touching the callers (the "minify" subcommand and -minify on serve).
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minifier rewrites src for the given file extension (".html", ".css",
+// ".js", ...). Extensions it doesn't recognise should be returned
+// unchanged.
+type Minifier interface {
+	Minify(ext string, src []byte) ([]byte, error)
+}
+
+// defaultMinify is the Minifier used by both "site minify" and the
+// -minify flag on "site serve".
+var defaultMinify Minifier = defaultMinifier{}
+
+type defaultMinifier struct{}
+
+func (defaultMinifier) Minify(ext string, src []byte) ([]byte, error) {
+	switch ext {
+	case ".html", ".htm":
+		return minifyHTML(src), nil
+	case ".css":
+		return minifyCSS(src), nil
+	case ".js":
+		return minifyJS(src), nil
+	default:
+		return src, nil
+	}
+}
+
+// runMinify implements the "minify" subcommand, rewriting matching
+// files under dir in place.
+func runMinify(args []string) {
+	fs := flag.NewFlagSet("minify", flag.ExitOnError)
+	dir := fs.String("dir", "_site/", "directory to minify in place")
+
+	if err := fs.Parse(args); err != nil {
+		os.Exit(1)
+	}
+
+	n := 0
+
+	err := filepath.Walk(*dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if ext != ".html" && ext != ".htm" && ext != ".css" && ext != ".js" {
+			return nil
+		}
+
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		out, err := defaultMinify.Minify(ext, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err := os.WriteFile(path, out, info.Mode()); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("minified %d file(s) in %s", n, *dir)
+}
+
+// minifyHTML strips comments and collapses runs of whitespace to a
+// single space, except inside <pre> and <textarea> elements whose
+// content is preserved verbatim, and inside <script> and <style>
+// elements whose content is run through minifyJS/minifyCSS instead.
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+
+	n := len(src)
+	i := 0
+	verbatim := "" // "pre" or "textarea" while inside one, else ""
+	lastWasSpace := false
+
+	for i < n {
+		c := src[i]
+
+		if c == '<' {
+			if verbatim == "" && bytes.HasPrefix(src[i:], []byte("<!--")) {
+				end := bytes.Index(src[i:], []byte("-->"))
+				if end == -1 {
+					break
+				}
+				i += end + len("-->")
+				continue
+			}
+
+			end := bytes.IndexByte(src[i:], '>')
+			if end == -1 {
+				out.Write(src[i:])
+				break
+			}
+
+			tag := src[i : i+end+1]
+			out.Write(tag)
+			i += end + 1
+			lastWasSpace = false
+
+			name, closing := htmlTagName(tag)
+
+			if verbatim == "" && !closing && (name == "script" || name == "style") {
+				bodyEnd := indexCloseTag(src[i:], name)
+				if bodyEnd == -1 {
+					out.Write(src[i:])
+					break
+				}
+
+				body := src[i : i+bodyEnd]
+				if name == "script" {
+					out.Write(minifyJS(body))
+				} else {
+					out.Write(minifyCSS(body))
+				}
+
+				i += bodyEnd
+				continue
+			}
+
+			switch {
+			case verbatim == "" && !closing && (name == "pre" || name == "textarea"):
+				verbatim = name
+			case verbatim != "" && closing && name == verbatim:
+				verbatim = ""
+			}
+			continue
+		}
+
+		if verbatim != "" {
+			out.WriteByte(c)
+			i++
+			continue
+		}
+
+		if isASCIISpace(c) {
+			if !lastWasSpace {
+				out.WriteByte(' ')
+				lastWasSpace = true
+			}
+			i++
+			continue
+		}
+
+		out.WriteByte(c)
+		lastWasSpace = false
+		i++
+	}
+
+	return out.Bytes()
+}
+
+// indexCloseTag returns the index of the start of the next "</name"
+// closing tag in src (case-insensitive), or -1 if there is none.
+func indexCloseTag(src []byte, name string) int {
+	for i := 0; i+1 < len(src); i++ {
+		if src[i] != '<' || src[i+1] != '/' {
+			continue
+		}
+
+		rest := src[i+2:]
+		if len(rest) < len(name) || !strings.EqualFold(string(rest[:len(name)]), name) {
+			continue
+		}
+
+		after := rest[len(name):]
+		if len(after) > 0 && !isASCIISpace(after[0]) && after[0] != '>' {
+			continue
+		}
+
+		return i
+	}
+	return -1
+}
+
+// htmlTagName extracts the (lowercased) element name from a tag such as
+// "<div class=\"x\">" or "</pre>", and reports whether it's a closing
+// tag.
+func htmlTagName(tag []byte) (name string, closing bool) {
+	tag = bytes.Trim(tag, "<>")
+	if len(tag) > 0 && tag[0] == '/' {
+		closing = true
+		tag = tag[1:]
+	}
+
+	i := 0
+	for i < len(tag) && !isASCIISpace(tag[i]) && tag[i] != '/' {
+		i++
+	}
+
+	return toLowerASCII(string(tag[:i])), closing
+}
+
+// minifyCSS collapses whitespace outside of string literals and
+// comments, and drops comments and semicolons immediately before a
+// closing brace.
+func minifyCSS(src []byte) []byte {
+	var out bytes.Buffer
+
+	n := len(src)
+	i := 0
+
+	for i < n {
+		c := src[i]
+
+		if c == '/' && i+1 < n && src[i+1] == '*' {
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end == -1 {
+				break
+			}
+			i += 2 + end + 2
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			j := cssStringEnd(src, i, c)
+			out.Write(src[i:j])
+			i = j
+			continue
+		}
+
+		if c == ';' {
+			j := i + 1
+			for j < n && isASCIISpace(src[j]) {
+				j++
+			}
+			if j < n && src[j] == '}' {
+				i = j
+				continue
+			}
+			out.WriteByte(';')
+			i++
+			continue
+		}
+
+		if isASCIISpace(c) {
+			j := i
+			for j < n && isASCIISpace(src[j]) {
+				j++
+			}
+			i = j
+
+			prev := lastByte(&out)
+			var next byte
+			if i < n {
+				next = src[i]
+			}
+			if !cssNoSpaceNeeded(prev) && !cssNoSpaceNeeded(next) {
+				out.WriteByte(' ')
+			}
+			continue
+		}
+
+		out.WriteByte(c)
+		i++
+	}
+
+	return out.Bytes()
+}
+
+func cssStringEnd(src []byte, i int, quote byte) int {
+	j := i + 1
+	for j < len(src) && src[j] != quote {
+		if src[j] == '\\' {
+			j++
+		}
+		j++
+	}
+	if j < len(src) {
+		j++
+	}
+	return j
+}
+
+func cssNoSpaceNeeded(b byte) bool {
+	switch b {
+	case '{', '}', ';', ':', ',', 0:
+		return true
+	}
+	return false
+}
+
+// minifyJS strips // and /* */ comments and collapses insignificant
+// whitespace, while leaving string, template and regex literals
+// untouched.
+func minifyJS(src []byte) []byte {
+	var out bytes.Buffer
+
+	n := len(src)
+	i := 0
+	var lastSignificant byte
+
+	for i < n {
+		c := src[i]
+
+		if c == '/' && i+1 < n && src[i+1] == '/' {
+			j := i + 2
+			for j < n && src[j] != '\n' {
+				j++
+			}
+			i = j
+			continue
+		}
+
+		if c == '/' && i+1 < n && src[i+1] == '*' {
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end == -1 {
+				break
+			}
+			i += 2 + end + 2
+			continue
+		}
+
+		if c == '"' || c == '\'' || c == '`' {
+			j := cssStringEnd(src, i, c)
+			out.Write(src[i:j])
+			lastSignificant = '"'
+			i = j
+			continue
+		}
+
+		if c == '/' && jsRegexAllowed(lastSignificant) {
+			j := jsRegexEnd(src, i)
+			out.Write(src[i:j])
+			lastSignificant = '/'
+			i = j
+			continue
+		}
+
+		if isASCIISpace(c) {
+			j := i
+			hasNewline := false
+			for j < n && isASCIISpace(src[j]) {
+				if src[j] == '\n' {
+					hasNewline = true
+				}
+				j++
+			}
+			i = j
+
+			prev := lastByte(&out)
+			var next byte
+			if i < n {
+				next = src[i]
+			}
+			switch {
+			case hasNewline:
+				// Keep the line break rather than collapsing to a
+				// space: a space doesn't trigger automatic semicolon
+				// insertion, so "var x = 1\nvar y = 2" would become
+				// the invalid "var x = 1 var y = 2".
+				out.WriteByte('\n')
+			case isJSWordByte(prev) && isJSWordByte(next):
+				out.WriteByte(' ')
+			}
+			continue
+		}
+
+		out.WriteByte(c)
+		lastSignificant = c
+		i++
+	}
+
+	return out.Bytes()
+}
+
+// jsRegexEnd returns the index just past the regex literal starting at
+// src[i] (src[i] == '/'), accounting for character classes and escapes.
+func jsRegexEnd(src []byte, i int) int {
+	n := len(src)
+	j := i + 1
+	inClass := false
+
+	for j < n {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				j++
+				// trailing flags
+				for j < n && isASCIILetter(src[j]) {
+					j++
+				}
+				return j
+			}
+		case '\n':
+			return j
+		}
+		j++
+	}
+	return n
+}
+
+// jsRegexAllowed reports whether a '/' following last can only start a
+// regex literal (as opposed to being a division operator).
+func jsRegexAllowed(last byte) bool {
+	switch {
+	case last == 0:
+		return true
+	case isJSWordByte(last):
+		return false
+	case last == ')' || last == ']':
+		return false
+	default:
+		return true
+	}
+}
+
+func isJSWordByte(b byte) bool {
+	return b == '_' || b == '$' || isASCIILetter(b) || (b >= '0' && b <= '9')
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func isASCIISpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
+
+func toLowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func lastByte(buf *bytes.Buffer) byte {
+	b := buf.Bytes()
+	if len(b) == 0 {
+		return 0
+	}
+	return b[len(b)-1]
+}
+
+// minifyCache holds the minified form of each file served with -minify,
+// keyed by path and invalidated whenever the file's mtime changes.
+type minifyCache struct {
+	mu      sync.Mutex
+	entries map[string]minifyCacheEntry
+}
+
+type minifyCacheEntry struct {
+	modTime time.Time
+	data    []byte
+}
+
+func newMinifyCache() *minifyCache {
+	return &minifyCache{entries: map[string]minifyCacheEntry{}}
+}
+
+func (c *minifyCache) get(name string, modTime time.Time, src []byte, ext string) ([]byte, error) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if ok && e.modTime.Equal(modTime) {
+		return e.data, nil
+	}
+
+	data, err := defaultMinify.Minify(ext, src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[name] = minifyCacheEntry{modTime: modTime, data: data}
+	c.mu.Unlock()
+
+	return data, nil
+}
+
+// minifyHandler wraps next, rewriting HTML, CSS and JS responses to
+// their minified form before they reach the client. Minified output is
+// cached in memory, keyed by each file's mtime.
+func (s *server) minifyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+		info, err := os.Stat(name)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if info.IsDir() {
+			name = filepath.Join(name, "index.html")
+			if info, err = os.Stat(name); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// Resolving a clean URL like "/about/" above may land on an
+		// index.html whose extension isn't visible in the request
+		// path at all, so the check has to happen on the file we
+		// actually resolved to, not on r.URL.Path.
+		ext := filepath.Ext(name)
+		if ext != ".html" && ext != ".htm" && ext != ".css" && ext != ".js" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		src, err := os.ReadFile(name)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		out, err := s.minifyCache.get(name, info.ModTime(), src, ext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", mime.TypeByExtension(ext))
+		w.Write(out)
+	})
+}
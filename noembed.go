@@ -0,0 +1,17 @@
+//go:build !embed
+
+package main
+
+import "net/http"
+
+// embedded reports whether the binary was built with the `embed` build
+// tag, i.e. whether _site/ was baked into the binary by genassets.
+//
+// See embed.go and assets_gen.go (produced by `go generate`).
+const embedded = false
+
+// newEmbeddedHandler is never called in this build; it exists so
+// serve.go doesn't need a build-tagged branch of its own.
+func newEmbeddedHandler() http.Handler {
+	panic("site: newEmbeddedHandler called without the embed build tag")
+}
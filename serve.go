@@ -1,12 +1,435 @@
 package main
 
-// Simple Go program to preview the site locally before publishing.
+// Local development server for previewing the site before publishing.
+//
+// Unlike a bare http.FileServer this wraps the served directory so that
+// requests for a directory without an index.html don't fall back to
+// Go's auto-generated listing, and (unless disabled) injects a small
+// script into served HTML pages that reloads the browser whenever the
+// watched directory changes on disk.
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
 )
 
-func main() {
-	log.Fatal(http.ListenAndServe("localhost:8080", http.FileServer(http.Dir("_site/"))))
+const reloadScriptFormat = `<script>(function(){
+	var proto = location.protocol === "https:" ? "wss://" : "ws://";
+	var sock = new WebSocket(proto + location.host + %q);
+	sock.onclose = function(){ setTimeout(function(){ location.reload(); }, 500); };
+	sock.onmessage = function(){ location.reload(); };
+})();</script>`
+
+// runServe implements the "serve" subcommand.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	dir := fs.String("dir", "_site/", "directory to serve")
+	watch := fs.String("watch", "", "comma-separated list of additional directories to watch for changes")
+	noReload := fs.Bool("no-reload", false, "disable live reload")
+	minify := fs.Bool("minify", false, "serve minified HTML, CSS and JS")
+	prefixFlag := fs.String("prefix", "/", "URL prefix to mount the site under, e.g. /blog/")
+
+	var proxies proxyRoutes
+	fs.Var(&proxies, "proxy", "repeatable prefix=upstream mapping to reverse proxy, e.g. -proxy=/api/=http://localhost:9000")
+
+	if err := fs.Parse(args); err != nil {
+		os.Exit(1)
+	}
+
+	if embedded {
+		// The site was baked into the binary at build time, so there's
+		// nothing on disk to watch or reload.
+		*noReload = true
+	}
+
+	prefix := normalizePrefix(*prefixFlag)
+
+	srv := &server{
+		dir:        *dir,
+		noReload:   *noReload,
+		minify:     *minify,
+		reloadPath: path.Join(prefix, "__reload"),
+	}
+	if *minify {
+		srv.minifyCache = newMinifyCache()
+	}
+
+	mux := http.NewServeMux()
+
+	for _, p := range proxies {
+		if p.prefix == prefix {
+			log.Fatalf("serve: -proxy=%s conflicts with -prefix=%s", p.prefix, prefix)
+		}
+
+		proxyHandler := http.StripPrefix(strings.TrimSuffix(p.prefix, "/"), httputil.NewSingleHostReverseProxy(p.target))
+		mux.Handle(p.prefix, proxyHandler)
+	}
+
+	handler := srv.fileHandler()
+	if prefix != "/" {
+		handler = http.StripPrefix(strings.TrimSuffix(prefix, "/"), handler)
+	}
+	mux.Handle(prefix, handler)
+
+	if !*noReload {
+		mux.HandleFunc(srv.reloadPath, srv.reloadHandler)
+
+		w, err := newWatcher(*dir, *watch, srv.reload)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+
+		go w.run()
+	}
+
+	log.Printf("serving %s on http://%s%s", *dir, *addr, prefix)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// normalizePrefix ensures p has both a leading and trailing slash, e.g.
+// "blog" and "/blog" both become "/blog/".
+func normalizePrefix(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if !strings.HasSuffix(p, "/") {
+		p = p + "/"
+	}
+	return p
+}
+
+// proxyRoute forwards requests under prefix to target.
+type proxyRoute struct {
+	prefix string
+	target *url.URL
+}
+
+// proxyRoutes implements flag.Value, accumulating one proxyRoute per
+// -proxy=prefix=upstream occurrence.
+type proxyRoutes []proxyRoute
+
+func (p *proxyRoutes) String() string {
+	if p == nil || len(*p) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(*p))
+	for i, r := range *p {
+		parts[i] = r.prefix + "=" + r.target.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *proxyRoutes) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("proxy %q: expected prefix=upstream", value)
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return fmt.Errorf("proxy %q: %w", value, err)
+	}
+
+	*p = append(*p, proxyRoute{prefix: normalizePrefix(parts[0]), target: u})
+	return nil
+}
+
+// server holds the state needed to serve the site and notify connected
+// browsers of rebuilds.
+type server struct {
+	dir        string
+	noReload   bool
+	minify     bool
+	reloadPath string
+
+	minifyCache *minifyCache
+
+	mu      sync.Mutex
+	clients []chan struct{}
+}
+
+// reload notifies every currently connected browser that it should
+// refresh the page.
+func (s *server) reload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.clients {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe registers a channel that receives a value each time reload
+// is called, until unsubscribe is invoked.
+func (s *server) subscribe() (ch chan struct{}, unsubscribe func()) {
+	ch = make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.clients = append(s.clients, ch)
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, c := range s.clients {
+			if c == ch {
+				s.clients = append(s.clients[:i], s.clients[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}
+}
+
+// fileHandler returns a handler that serves files out of dir without
+// falling back to directory listings, injecting the reload script into
+// HTML responses when live reload is enabled.
+func (s *server) fileHandler() http.Handler {
+	if embedded {
+		return newEmbeddedHandler()
+	}
+
+	var handler http.Handler = http.FileServer(onlyFilesFS{http.Dir(s.dir)})
+
+	if s.minify {
+		handler = s.minifyHandler(handler)
+	}
+
+	if s.noReload {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w, buf: &bytes.Buffer{}}
+		handler.ServeHTTP(rec, r)
+		rec.flush(s.reloadPath)
+	})
+}
+
+// onlyFilesFS wraps an http.FileSystem so that opening a directory
+// whose index.html is missing returns os.ErrNotExist instead of a
+// directory handle, which stops http.FileServer from generating a
+// listing for it.
+type onlyFilesFS struct {
+	fs http.FileSystem
+}
+
+func (fs onlyFilesFS) Open(name string) (http.File, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return f, nil
+	}
+
+	index := filepath.Join(name, "index.html")
+
+	idx, err := fs.fs.Open(index)
+	if err != nil {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	f.Close()
+	return idx, nil
+}
+
+// responseRecorder buffers a response so the reload script can be
+// injected before the body reaches the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	buf    *bytes.Buffer
+	status int
+}
+
+func (r *responseRecorder) WriteHeader(status int) { r.status = status }
+
+func (r *responseRecorder) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+func (r *responseRecorder) flush(reloadPath string) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	body := r.buf.Bytes()
+
+	if r.status == http.StatusOK && bytes.Contains(body, []byte("</body>")) {
+		script := fmt.Sprintf(reloadScriptFormat, reloadPath)
+		body = bytes.Replace(body, []byte("</body>"), append([]byte(script), []byte("</body>")...), 1)
+		r.Header().Del("Content-Length")
+	}
+
+	r.ResponseWriter.WriteHeader(r.status)
+	r.ResponseWriter.Write(body)
+}
+
+// watcher calls reload whenever a file under any of the watched
+// directories changes.
+type watcher struct {
+	fs     *fsnotify.Watcher
+	reload func()
+}
+
+func newWatcher(dir, extra string, reload func()) (*watcher, error) {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{dir}
+	if extra != "" {
+		dirs = append(dirs, strings.Split(extra, ",")...)
+	}
+
+	for _, d := range dirs {
+		if err := addRecursive(fs, d); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+
+	return &watcher{fs: fs, reload: reload}, nil
+}
+
+func addRecursive(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+}
+
+func (w *watcher) Close() error { return w.fs.Close() }
+
+func (w *watcher) run() {
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				w.reload()
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watch: %s", err)
+		}
+	}
+}
+
+// reloadHandler upgrades the request to a websocket connection and
+// pushes a message to the client every time s.reload fires.
+func (s *server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	ch, unsubscribe := s.subscribe()
+	defer unsubscribe()
+
+	for range ch {
+		if err := conn.writeTextFrame([]byte("reload")); err != nil {
+			return
+		}
+	}
+}
+
+// wsConn is a minimal RFC 6455 server connection, enough to push
+// unsolicited text frames to the browser for live reload.
+type wsConn struct {
+	io.ReadWriteCloser
+}
+
+const wsMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, io.ErrClosedPipe
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsMagic))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	rw.Flush()
+
+	return &wsConn{conn}, nil
+}
+
+func (c *wsConn) writeTextFrame(payload []byte) error {
+	var header bytes.Buffer
+	header.WriteByte(0x81) // FIN + text opcode
+
+	n := len(payload)
+	switch {
+	case n < 126:
+		header.WriteByte(byte(n))
+	case n < 1<<16:
+		header.WriteByte(126)
+		binary.Write(&header, binary.BigEndian, uint16(n))
+	default:
+		header.WriteByte(127)
+		binary.Write(&header, binary.BigEndian, uint64(n))
+	}
+
+	if _, err := c.Write(header.Bytes()); err != nil {
+		return err
+	}
+	_, err := c.Write(payload)
+	return err
 }